@@ -0,0 +1,441 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/quic-go/quic-go"
+)
+
+// defaultQUICPoolSize is the default maximum number of concurrent
+// quic.Connection instances a quicConnPool will keep open to a single
+// upstream.
+const defaultQUICPoolSize = 1
+
+// defaultQUICMaxStreamsPerConn is the default cap on the number of streams a
+// pooled connection is allowed to have in flight before the pool prefers
+// opening another connection instead of reusing it.
+const defaultQUICMaxStreamsPerConn = 0 // 0 means unlimited.
+
+// defaultQUICIdleTimeout is the default amount of time a pooled connection
+// may sit unused before the pool evicts it.
+const defaultQUICIdleTimeout = 5 * time.Minute
+
+// quicDialFunc opens a brand new quic.Connection to the upstream.  It is
+// supplied by the caller of newQUICConnPool so that the pool itself stays
+// agnostic of bootstrapping, TLS and QUIC configuration.
+type quicDialFunc func() (quic.Connection, error)
+
+// pooledQUICConn wraps a single quic.Connection together with the pool
+// bookkeeping needed to decide when it should be reused, recycled, or
+// evicted.  A pooledQUICConn is appended to its pool's conns slice as soon
+// as a slot for it is reserved, before the (potentially slow) dial that
+// fills in conn has completed; dialDone is closed once that dial finishes,
+// successfully or not.
+type pooledQUICConn struct {
+	// conn is nil until the dial that reserved this slot completes
+	// successfully.
+	conn quic.Connection
+
+	// dialDone is closed once the dial that was reserving this slot
+	// completes, whether it succeeded or failed.
+	dialDone chan struct{}
+
+	// dialErr is the error from the reserving dial, if any.  It is only
+	// valid to read once dialDone is closed.
+	dialErr error
+
+	// mu protects the mutable fields below.
+	mu sync.Mutex
+
+	// streams is the number of streams currently considered open on this
+	// connection.
+	streams int
+
+	// healthy is false until the dial that created this connection
+	// succeeds, and again once an exchange on the connection has failed
+	// (see markUnhealthy); either way it should no longer be handed out.
+	healthy bool
+
+	// lastUsed is updated every time a stream is acquired from this
+	// connection, and is used to decide idle eviction.
+	lastUsed time.Time
+}
+
+// QUICPoolStats describes the current state of a quicConnPool, for use by
+// callers that want to observe pool churn (e.g. via [Options] consumers).
+type QUICPoolStats struct {
+	// OpenConns is the number of connections currently tracked by the pool,
+	// healthy or not.
+	OpenConns int
+
+	// HealthyConns is the number of connections currently considered usable.
+	HealthyConns int
+
+	// TotalStreams is the sum of in-flight streams across all tracked
+	// connections.
+	TotalStreams int
+}
+
+// quicConnPool is a pool of quic.Connection instances to a single upstream.
+// Unlike keeping a single cached connection, the pool can keep several
+// connections open at once, track their health independently, and evict
+// connections that stateless resets, idle timeouts, or NO_ERROR shutdowns
+// have invalidated without disrupting streams still in flight on other
+// connections.
+type quicConnPool struct {
+	// dial opens a new underlying connection.
+	dial quicDialFunc
+
+	// maxSize is the maximum number of connections the pool will keep open
+	// at once.
+	maxSize int
+
+	// maxStreamsPerConn is the maximum number of in-flight streams a
+	// connection may have before the pool opens another one instead of
+	// reusing it.  Zero means unlimited.
+	maxStreamsPerConn int
+
+	// idleTTL is how long a connection may go unused before it is evicted.
+	idleTTL time.Duration
+
+	// observer receives structured telemetry about connection closes.  It
+	// is never nil: newQUICConnPool falls back to noopQUICObserver{}.
+	observer QUICObserver
+
+	// mu protects conns and closed.
+	mu sync.Mutex
+
+	// conns holds every connection currently tracked by the pool.
+	conns []*pooledQUICConn
+
+	// closed is true once closeAll has run.  get refuses to dial further
+	// connections once closed, so that closeAll's view of conns remains a
+	// complete record of everything that needs closing.
+	closed bool
+}
+
+// newQUICConnPool returns a new *quicConnPool.  maxSize, maxStreamsPerConn,
+// and idleTTL fall back to their respective defaults when zero.  observer
+// may be nil, in which case connection closes are not reported anywhere.
+func newQUICConnPool(
+	dial quicDialFunc,
+	maxSize int,
+	maxStreamsPerConn int,
+	idleTTL time.Duration,
+	observer QUICObserver,
+) (pool *quicConnPool) {
+	if maxSize <= 0 {
+		maxSize = defaultQUICPoolSize
+	}
+	if idleTTL <= 0 {
+		idleTTL = defaultQUICIdleTimeout
+	}
+	if observer == nil {
+		observer = noopQUICObserver{}
+	}
+
+	return &quicConnPool{
+		dial:              dial,
+		maxSize:           maxSize,
+		maxStreamsPerConn: maxStreamsPerConn,
+		idleTTL:           idleTTL,
+		observer:          observer,
+	}
+}
+
+// get returns a healthy, non-overloaded connection from the pool, dialing a
+// new one only if every existing connection is either unhealthy or at its
+// stream cap and the pool has room.  When the pool is full, the least busy
+// healthy connection is returned even if it is at its stream cap.
+//
+// The "is there room" check and the reservation of that room are done under
+// the same pool.mu critical section (by appending a placeholder
+// *pooledQUICConn before the dial runs), so that concurrent callers racing
+// to fill the last slot cannot all observe room and all dial: only one of
+// them reserves the slot, and the rest either reuse a connection or wait on
+// the reservation's dial to finish.
+func (pool *quicConnPool) get() (pc *pooledQUICConn, err error) {
+	for {
+		pool.mu.Lock()
+
+		if pool.closed {
+			pool.mu.Unlock()
+
+			return nil, fmt.Errorf("quic pool: closed")
+		}
+
+		pool.evictLocked()
+
+		for _, c := range pool.conns {
+			if pool.acquireIfUsable(c) {
+				pool.mu.Unlock()
+
+				return c, nil
+			}
+		}
+
+		if len(pool.conns) < pool.maxSize {
+			pc = &pooledQUICConn{dialDone: make(chan struct{}), lastUsed: time.Now()}
+			pc.acquire()
+			pool.conns = append(pool.conns, pc)
+			pool.mu.Unlock()
+
+			return pc, pool.finishDial(pc)
+		}
+
+		// The pool is full.  Prefer reusing the least busy healthy
+		// connection; if none is healthy, wait for a dial that is still in
+		// flight to complete and retry rather than exceeding maxSize.
+		best := pool.leastBusyLocked()
+		pending := pool.firstPendingLocked()
+		pool.mu.Unlock()
+
+		if best != nil {
+			best.acquire()
+
+			return best, nil
+		}
+
+		if pending == nil {
+			return nil, fmt.Errorf("quic pool: no usable connection to %d max", pool.maxSize)
+		}
+
+		<-pending.dialDone
+		if pending.dialErr == nil {
+			pool.mu.Lock()
+			ok := pool.acquireIfUsable(pending)
+			pool.mu.Unlock()
+
+			if ok {
+				return pending, nil
+			}
+		}
+		// Either the dial failed, or another waiter already claimed pending
+		// (or it was evicted) in the time it took us to wake up; go around
+		// and re-evaluate the whole pool from scratch.
+	}
+}
+
+// finishDial runs the pool's dial function to fill in a reserved connection
+// slot created by get, recording the result on pc and closing pc.dialDone so
+// that any callers waiting on this reservation unblock.  On failure, pc is
+// removed from the pool so its slot can be reused.
+func (pool *quicConnPool) finishDial(pc *pooledQUICConn) (err error) {
+	conn, err := pool.dial()
+
+	pc.mu.Lock()
+	if err == nil {
+		pc.conn = conn
+		pc.healthy = true
+	}
+	pc.dialErr = err
+	pc.mu.Unlock()
+	close(pc.dialDone)
+
+	if err != nil {
+		pool.removeConn(pc)
+	}
+
+	return err
+}
+
+// firstPendingLocked returns a reserved connection slot whose dial has not
+// yet completed, or nil if every tracked connection has already finished
+// dialing.  pool.mu must be held by the caller.
+func (pool *quicConnPool) firstPendingLocked() (pending *pooledQUICConn) {
+	for _, c := range pool.conns {
+		select {
+		case <-c.dialDone:
+		default:
+			return c
+		}
+	}
+
+	return nil
+}
+
+// removeConn removes pc from the pool, if still present.
+func (pool *quicConnPool) removeConn(pc *pooledQUICConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for i, c := range pool.conns {
+		if c == pc {
+			pool.conns = append(pool.conns[:i], pool.conns[i+1:]...)
+
+			break
+		}
+	}
+}
+
+// acquireIfUsable marks c as acquired and returns true if it is healthy and
+// under the pool's per-connection stream cap.  pool.mu must be held by the
+// caller.
+func (pool *quicConnPool) acquireIfUsable(c *pooledQUICConn) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.healthy {
+		return false
+	}
+	if pool.maxStreamsPerConn > 0 && c.streams >= pool.maxStreamsPerConn {
+		return false
+	}
+
+	c.streams++
+	c.lastUsed = time.Now()
+
+	return true
+}
+
+// leastBusyLocked returns the healthy connection with the fewest in-flight
+// streams, or nil if none are healthy.  pool.mu must be held by the caller.
+func (pool *quicConnPool) leastBusyLocked() (best *pooledQUICConn) {
+	var bestStreams int
+	for _, c := range pool.conns {
+		c.mu.Lock()
+		healthy, streams := c.healthy, c.streams
+		c.mu.Unlock()
+
+		if !healthy {
+			continue
+		}
+		if best == nil || streams < bestStreams {
+			best, bestStreams = c, streams
+		}
+	}
+
+	return best
+}
+
+// acquire records the start of a new stream on pc.
+func (pc *pooledQUICConn) acquire() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.streams++
+	pc.lastUsed = time.Now()
+}
+
+// release records the end of a stream previously started with acquire.
+func (pc *pooledQUICConn) release() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.streams > 0 {
+		pc.streams--
+	}
+}
+
+// markUnhealthy flags pc so that the pool stops handing it out and removes
+// it from the pool right away, so that its slot can be refilled by the next
+// get.  The connection itself is closed asynchronously, so that streams
+// still in flight on other connections are left untouched.
+func (pool *quicConnPool) markUnhealthy(pc *pooledQUICConn, cause error) {
+	pc.mu.Lock()
+	pc.healthy = false
+	pc.mu.Unlock()
+
+	pool.removeConn(pc)
+	go pool.evict(pc, cause)
+}
+
+// evict closes pc and removes it from the pool.
+func (pool *quicConnPool) evict(pc *pooledQUICConn, cause error) {
+	code := QUICCodeNoError
+	reason := ""
+	if cause != nil {
+		code = QUICCodeInternalError
+		reason = cause.Error()
+	}
+
+	if pc.conn != nil {
+		if err := pc.conn.CloseWithError(code, ""); err != nil {
+			log.Debug("quic pool: closing evicted conn: %v", err)
+		}
+		pool.observer.OnConnectionClose(code, reason)
+	}
+
+	pool.removeConn(pc)
+}
+
+// evictLocked removes connections that have been idle for longer than
+// idleTTL.  Connections whose reserving dial has not completed yet (conn ==
+// nil) are never eligible for idle eviction.  pool.mu must be held by the
+// caller.
+func (pool *quicConnPool) evictLocked() {
+	if pool.idleTTL <= 0 {
+		return
+	}
+
+	now := time.Now()
+	alive := pool.conns[:0]
+	for _, c := range pool.conns {
+		c.mu.Lock()
+		idle := c.conn != nil && c.streams == 0 && now.Sub(c.lastUsed) > pool.idleTTL
+		c.mu.Unlock()
+
+		if idle {
+			go func(c *pooledQUICConn) {
+				_ = c.conn.CloseWithError(QUICCodeNoError, "")
+				pool.observer.OnConnectionClose(QUICCodeNoError, "idle timeout")
+			}(c)
+
+			continue
+		}
+
+		alive = append(alive, c)
+	}
+	pool.conns = alive
+}
+
+// closeAll closes every connection tracked by the pool, including ones whose
+// reserving dial is still in flight: it waits for each such dial to finish
+// before closing the connection it produced, so that a dial racing with
+// Close can never outlive closeAll and leak.  Once closeAll has run, the
+// pool refuses to dial any further connections (see get).
+func (pool *quicConnPool) closeAll() (err error) {
+	pool.mu.Lock()
+	pool.closed = true
+	conns := pool.conns
+	pool.conns = nil
+	pool.mu.Unlock()
+
+	for _, c := range conns {
+		// A no-op if the dial that reserved this slot has already
+		// completed.
+		<-c.dialDone
+
+		if c.conn == nil {
+			// The reserving dial failed; there is nothing to close.
+			continue
+		}
+		if cErr := c.conn.CloseWithError(QUICCodeNoError, ""); cErr != nil {
+			err = cErr
+		}
+		pool.observer.OnConnectionClose(QUICCodeNoError, "")
+	}
+
+	return err
+}
+
+// stats returns a snapshot of the pool's current state.
+func (pool *quicConnPool) stats() (s QUICPoolStats) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	s.OpenConns = len(pool.conns)
+	for _, c := range pool.conns {
+		c.mu.Lock()
+		if c.healthy {
+			s.HealthyConns++
+		}
+		s.TotalStreams += c.streams
+		c.mu.Unlock()
+	}
+
+	return s
+}
@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// fakeQUICConn is a [quic.Connection] that only implements CloseWithError;
+// every other method panics if called, since the pool tests below never
+// exercise them.
+type fakeQUICConn struct {
+	quic.Connection
+
+	closed atomic.Bool
+}
+
+func (c *fakeQUICConn) CloseWithError(quic.ApplicationErrorCode, string) error {
+	c.closed.Store(true)
+
+	return nil
+}
+
+// TestQuicConnPool_get_respectsMaxSize asserts that a burst of concurrent
+// get calls never dials more connections than maxSize, even though the
+// "room available" check and the dial happen in separate critical sections.
+func TestQuicConnPool_get_respectsMaxSize(t *testing.T) {
+	const maxSize = 2
+	const callers = 20
+
+	var dials atomic.Int32
+	dial := func() (quic.Connection, error) {
+		dials.Add(1)
+		time.Sleep(10 * time.Millisecond)
+
+		return &fakeQUICConn{}, nil
+	}
+
+	pool := newQUICConnPool(dial, maxSize, 0, 0, nil)
+
+	var wg sync.WaitGroup
+	pcs := make([]*pooledQUICConn, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			pc, err := pool.get()
+			if err != nil {
+				t.Errorf("get: %v", err)
+
+				return
+			}
+
+			pcs[i] = pc
+		}(i)
+	}
+	wg.Wait()
+
+	if got := dials.Load(); got > maxSize {
+		t.Errorf("pool dialed %d connections, want at most %d", got, maxSize)
+	}
+
+	if got := pool.stats().OpenConns; got > maxSize {
+		t.Errorf("pool tracks %d connections, want at most %d", got, maxSize)
+	}
+
+	for _, pc := range pcs {
+		if pc != nil {
+			pc.release()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package quicmetrics provides a Prometheus-backed implementation of
+// [upstream.QUICObserver] for operators who want to expose DoQ connection
+// and stream telemetry as metrics.
+package quicmetrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go"
+)
+
+// PrometheusObserver is an [upstream.QUICObserver] that records every event
+// as a Prometheus metric.  Use [NewPrometheusObserver] to construct one and
+// register it with a [prometheus.Registerer].
+type PrometheusObserver struct {
+	handshakes *prometheus.HistogramVec
+	retries    *prometheus.CounterVec
+	closes     *prometheus.CounterVec
+	streamRTT  prometheus.Histogram
+}
+
+// type check
+var _ upstream.QUICObserver = (*PrometheusObserver)(nil)
+
+// NewPrometheusObserver returns a new *PrometheusObserver whose metrics are
+// all prefixed with "dnsproxy_quic_".  It does not register the metrics; the
+// caller must register them, e.g. via reg.MustRegister(o.Collectors()...).
+func NewPrometheusObserver() (o *PrometheusObserver) {
+	return &PrometheusObserver{
+		handshakes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "dnsproxy",
+			Subsystem: "quic",
+			Name:      "handshake_duration_seconds",
+			Help:      "Duration of QUIC handshakes, labeled by resumption and 0-RTT outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"resumed", "zero_rtt_accepted"}),
+
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Subsystem: "quic",
+			Name:      "retries_total",
+			Help:      "Number of times a DoQ upstream retried a query on a new connection.",
+		}, []string{"attempt"}),
+
+		closes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Subsystem: "quic",
+			Name:      "connection_closes_total",
+			Help:      "Number of QUIC connections closed, labeled by application error code.",
+		}, []string{"code"}),
+
+		streamRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "dnsproxy",
+			Subsystem: "quic",
+			Name:      "stream_rtt_seconds",
+			Help:      "Round-trip time of a single query/response exchange over a QUIC stream.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+}
+
+// Collectors returns every metric collector owned by o, for convenient bulk
+// registration.
+func (o *PrometheusObserver) Collectors() (collectors []prometheus.Collector) {
+	return []prometheus.Collector{o.handshakes, o.retries, o.closes, o.streamRTT}
+}
+
+// OnHandshake implements the [upstream.QUICObserver] interface for
+// *PrometheusObserver.
+func (o *PrometheusObserver) OnHandshake(duration time.Duration, resumed, zeroRTTAccepted bool) {
+	o.handshakes.WithLabelValues(strconv.FormatBool(resumed), strconv.FormatBool(zeroRTTAccepted)).
+		Observe(duration.Seconds())
+}
+
+// OnRetry implements the [upstream.QUICObserver] interface for
+// *PrometheusObserver.
+func (o *PrometheusObserver) OnRetry(_ error, attempt int) {
+	o.retries.WithLabelValues(strconv.Itoa(attempt)).Inc()
+}
+
+// OnConnectionClose implements the [upstream.QUICObserver] interface for
+// *PrometheusObserver.
+func (o *PrometheusObserver) OnConnectionClose(code quic.ApplicationErrorCode, _ string) {
+	o.closes.WithLabelValues(strconv.FormatUint(uint64(code), 10)).Inc()
+}
+
+// OnStreamRTT implements the [upstream.QUICObserver] interface for
+// *PrometheusObserver.
+func (o *PrometheusObserver) OnStreamRTT(duration time.Duration) {
+	o.streamRTT.Observe(duration.Seconds())
+}
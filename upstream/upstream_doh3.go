@@ -0,0 +1,495 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// dohMimeType is the MIME type for DNS message content, as specified in
+// RFC 8484.
+const dohMimeType = "application/dns-message"
+
+// dnsOverHTTPS3 implements the [Upstream] interface for the DNS-over-HTTPS
+// protocol, but only ever negotiating HTTP/3 (see [Options.PreferHTTP3] and
+// [Options.ForceHTTP3]).
+//
+// See https://www.rfc-editor.org/rfc/rfc9114 and
+// https://www.rfc-editor.org/rfc/rfc8484.
+type dnsOverHTTPS3 struct {
+	// getDialer either returns an initialized dial handler or creates a new
+	// one.
+	getDialer DialerInitializer
+
+	// addr is the DNS-over-HTTPS server URL.
+	addr *url.URL
+
+	// tlsConf is the configuration of TLS.
+	tlsConf *tls.Config
+
+	// quicConfig is the QUIC configuration that is used for establishing
+	// connections to the upstream.
+	quicConfig *quic.Config
+
+	// client is the lazily initialized *http.Client that's pinned to the
+	// round tripper chosen during negotiation.
+	client *http.Client
+
+	// clientMu protects client.
+	clientMu sync.Mutex
+
+	// timeout is the timeout for the upstream connection.
+	timeout time.Duration
+}
+
+// type check
+var _ Upstream = (*dnsOverHTTPS3)(nil)
+
+// newDoH3 returns the DNS-over-HTTPS Upstream that is pinned to HTTP/3, to be
+// used when [Options.ForceHTTP3] is set or after [Options.PreferHTTP3]
+// negotiation has chosen HTTP/3.
+func newDoH3(addr *url.URL, opts *Options) (u Upstream, err error) {
+	addPort(addr, defaultPortDoH)
+
+	getDialer, err := newDialerInitializer(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	u = &dnsOverHTTPS3{
+		getDialer: getDialer,
+		addr:      addr,
+		quicConfig: &quic.Config{
+			KeepAlivePeriod: QUICKeepAlivePeriod,
+			TokenStore:      newQUICTokenStore(0, 0),
+			Tracer:          opts.QUICTracer,
+		},
+		tlsConf: &tls.Config{
+			ServerName:         addr.Hostname(),
+			RootCAs:            RootCAs,
+			CipherSuites:       CipherSuites,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opts.InsecureSkipVerify,
+			NextProtos:         []string{http3.NextProtoH3},
+		},
+		timeout: opts.Timeout,
+	}
+
+	runtime.SetFinalizer(u, (*dnsOverHTTPS3).Close)
+
+	return u, nil
+}
+
+// Address implements the [Upstream] interface for *dnsOverHTTPS3.
+func (p *dnsOverHTTPS3) Address() string { return p.addr.String() }
+
+// Exchange implements the [Upstream] interface for *dnsOverHTTPS3.
+func (p *dnsOverHTTPS3) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	client, err := p.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to init http3 client: %w", err)
+	}
+
+	resp, err = p.exchangeHTTPS3Client(client, m)
+	if err != nil {
+		// The most common cause for a broken HTTP/3 client is a connection
+		// that the server has since closed, see isQUICRetryError.  Re-create
+		// the client and retry once, similar to the *dnsOverQUIC workaround
+		// (which retries up to twice).
+		if !isQUICRetryError(err) {
+			return nil, err
+		}
+
+		log.Debug("re-creating the HTTP/3 client and retrying due to %v", err)
+
+		client, err = p.resetClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-init http3 client: %w", err)
+		}
+
+		resp, err = p.exchangeHTTPS3Client(client, m)
+	}
+
+	return resp, err
+}
+
+// Close implements the [Upstream] interface for *dnsOverHTTPS3.
+func (p *dnsOverHTTPS3) Close() (err error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	runtime.SetFinalizer(p, nil)
+
+	if p.client == nil {
+		return nil
+	}
+
+	if rt, ok := p.client.Transport.(*http3.RoundTripper); ok {
+		err = rt.Close()
+	}
+	p.client = nil
+
+	return err
+}
+
+// exchangeHTTPS3Client sends the DNS message using the given HTTP/3 client
+// and returns the response it got from the server.
+func (p *dnsOverHTTPS3) exchangeHTTPS3Client(
+	client *http.Client,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS message for DoH3: %w", err)
+	}
+
+	ctx, cancel := p.withDeadline(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.addr.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("creating http request to %s: %w", p.addr, err)
+	}
+	req.Header.Set("Content-Type", dohMimeType)
+	req.Header.Set("Accept", dohMimeType)
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", p.addr, err)
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s: %w", p.addr, err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"expected status %d from %s, got %d",
+			http.StatusOK,
+			p.addr,
+			httpResp.StatusCode,
+		)
+	}
+
+	resp = new(dns.Msg)
+	err = resp.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", p.addr, err)
+	}
+
+	return resp, nil
+}
+
+// getClient returns the existing HTTP/3 client or lazily creates a new one.
+func (p *dnsOverHTTPS3) getClient() (client *http.Client, err error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	return p.createClient()
+}
+
+// resetClient closes the current HTTP/3 client, if any, and creates a new
+// one in its place.
+func (p *dnsOverHTTPS3) resetClient() (client *http.Client, err error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if p.client != nil {
+		if rt, ok := p.client.Transport.(*http3.RoundTripper); ok {
+			_ = rt.Close()
+		}
+		p.client = nil
+	}
+
+	return p.createClient()
+}
+
+// createClient creates a new *http.Client pinned to an HTTP/3 round
+// tripper.  p.clientMu is expected to be held by the caller.
+func (p *dnsOverHTTPS3) createClient() (client *http.Client, err error) {
+	dialContext, err := p.getDialer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to bootstrap HTTP/3 connection: %w", err)
+	}
+
+	rt := &http3.RoundTripper{
+		TLSClientConfig: p.tlsConf.Clone(),
+		QuicConfig:      p.quicConfig,
+		Dial: func(
+			ctx context.Context,
+			_ string,
+			tlsCfg *tls.Config,
+			cfg *quic.Config,
+		) (quic.EarlyConnection, error) {
+			rawConn, dialErr := dialContext(ctx, "udp", "")
+			if dialErr != nil {
+				return nil, fmt.Errorf("failed to open a QUIC connection: %w", dialErr)
+			}
+			_ = rawConn.Close()
+
+			return quic.DialAddrEarlyContext(ctx, p.addr.Host, tlsCfg, cfg)
+		},
+	}
+
+	client = &http.Client{Transport: rt}
+	p.client = client
+
+	return client, nil
+}
+
+// withDeadline returns a copy of parent with the upstream's timeout applied,
+// if any.
+func (p *dnsOverHTTPS3) withDeadline(
+	parent context.Context,
+) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancel = parent, func() {}
+	if p.timeout > 0 {
+		ctx, cancel = context.WithDeadline(ctx, time.Now().Add(p.timeout))
+	}
+
+	return ctx, cancel
+}
+
+// newDoH3Upstream returns the DNS-over-HTTPS [Upstream], choosing between
+// plain HTTP/2 (see newDoH) and HTTP/3 (see newDoH3) according to
+// [Options.ForceHTTP3] and [Options.PreferHTTP3].
+func newDoH3Upstream(addr *url.URL, opts *Options) (u Upstream, err error) {
+	switch {
+	case opts.ForceHTTP3:
+		return newDoH3(addr, opts)
+	case opts.PreferHTTP3:
+		return &dohH3Negotiator{addr: addr, opts: opts}, nil
+	default:
+		return newDoH(addr, opts)
+	}
+}
+
+// dohH3Negotiator is an [Upstream] that picks between HTTP/2 and HTTP/3 on
+// its first Exchange call and then pins that choice for the rest of its
+// lifetime.  It implements the "prefer HTTP/3" negotiation: an H3 dial is
+// raced against an H2 dial, and whichever transport completes a connection
+// first wins.
+type dohH3Negotiator struct {
+	// addr is the DNS-over-HTTPS server URL.
+	addr *url.URL
+
+	// opts are the options this negotiator was created with.
+	opts *Options
+
+	// once guards the resolution of pinned below.
+	once sync.Once
+
+	// pinned is the Upstream chosen by negotiation.  It is only valid to
+	// read once once has fired.
+	pinned Upstream
+
+	// resolveErr is the error, if any, encountered while negotiating.  It is
+	// only valid to read once once has fired.
+	resolveErr error
+}
+
+// type check
+var _ Upstream = (*dohH3Negotiator)(nil)
+
+// Address implements the [Upstream] interface for *dohH3Negotiator.
+func (n *dohH3Negotiator) Address() string { return n.addr.String() }
+
+// Exchange implements the [Upstream] interface for *dohH3Negotiator.
+func (n *dohH3Negotiator) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	pinned, err := n.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return pinned.Exchange(m)
+}
+
+// Close implements the [Upstream] interface for *dohH3Negotiator.
+func (n *dohH3Negotiator) Close() (err error) {
+	n.once.Do(func() {
+		n.resolveErr = errNegotiatorClosedBeforeUse
+	})
+
+	if n.pinned != nil {
+		return n.pinned.Close()
+	}
+
+	return nil
+}
+
+// resolve negotiates the transport to use, on the first call only, and
+// returns the pinned upstream for all subsequent calls.
+func (n *dohH3Negotiator) resolve() (pinned Upstream, err error) {
+	n.once.Do(func() {
+		n.pinned, n.resolveErr = raceHTTP3(n.addr, n.opts)
+	})
+
+	return n.pinned, n.resolveErr
+}
+
+// errNegotiatorClosedBeforeUse is a sentinel placeholder error recorded when
+// a *dohH3Negotiator is closed before its first Exchange call, so that a
+// racing Exchange does not attempt to negotiate after Close.
+var errNegotiatorClosedBeforeUse = fmt.Errorf("doh3: negotiator closed before first use")
+
+// dialResult is the outcome of one side of a raceUpstreams race.
+type dialResult struct {
+	u   Upstream
+	err error
+}
+
+// raceHTTP3 dials both an HTTP/3 and an HTTP/2 upstream for addr
+// concurrently and returns whichever one actually becomes reachable first.
+// addr is cloned before being handed to each side, since both newDoH3 and
+// newDoH mutate the *url.URL they're given (see addPort) and would otherwise
+// race on the same pointer.
+func raceHTTP3(addr *url.URL, opts *Options) (winner Upstream, err error) {
+	return raceUpstreams(
+		func() (Upstream, error) { return dialH3Probed(cloneURL(addr), opts) },
+		func() (Upstream, error) { return newDoH(cloneURL(addr), opts) },
+	)
+}
+
+// dialH3Probed constructs a *dnsOverHTTPS3 for addr and confirms it can
+// actually reach the upstream over QUIC before returning it, closing it and
+// returning an error instead if the probe fails.
+func dialH3Probed(addr *url.URL, opts *Options) (u Upstream, err error) {
+	u, err = newDoH3(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	h3 := u.(*dnsOverHTTPS3)
+	if err = h3.dialProbe(); err != nil {
+		_ = h3.Close()
+
+		return nil, err
+	}
+
+	return h3, nil
+}
+
+// dialProbe confirms that p can actually establish a QUIC connection to its
+// upstream by performing a real dial, independent of the lazily-dialing
+// http3.RoundTripper used for actual exchanges.  The probe connection is
+// closed immediately; it exists only to validate reachability.
+func (p *dnsOverHTTPS3) dialProbe() (err error) {
+	dialContext, err := p.getDialer()
+	if err != nil {
+		return fmt.Errorf("failed to bootstrap QUIC connection: %w", err)
+	}
+
+	rawConn, err := dialContext(context.Background(), "udp", "")
+	if err != nil {
+		return fmt.Errorf("failed to open a QUIC connection: %w", err)
+	}
+	_ = rawConn.Close()
+
+	udpConn, ok := rawConn.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("failed to open connection to %s", p.addr)
+	}
+
+	ctx, cancel := p.withDeadline(context.Background())
+	defer cancel()
+
+	conn, err := quic.DialAddrEarlyContext(ctx, udpConn.RemoteAddr().String(), p.tlsConf.Clone(), p.quicConfig)
+	if err != nil {
+		return fmt.Errorf("probing http3 connectivity to %s: %w", p.addr, err)
+	}
+
+	_ = conn.CloseWithError(QUICCodeNoError, "")
+
+	return nil
+}
+
+// cloneURL returns a shallow copy of addr, safe to pass to functions (like
+// newDoH3 and newDoH) that mutate the URL they're given.
+func cloneURL(addr *url.URL) (clone *url.URL) {
+	cp := *addr
+
+	return &cp
+}
+
+// raceUpstreams runs dialA and dialB concurrently and returns whichever one
+// succeeds first.  If the first to finish failed, it waits for the other.
+// The loser, if it also succeeded, is closed.  If both fail, the returned
+// error includes both errors and wraps the one from dialB.
+func raceUpstreams(dialA, dialB func() (Upstream, error)) (winner Upstream, err error) {
+	aRes := make(chan dialResult, 1)
+	bRes := make(chan dialResult, 1)
+
+	go func() {
+		u, dialErr := dialA()
+		aRes <- dialResult{u: u, err: dialErr}
+	}()
+	go func() {
+		u, dialErr := dialB()
+		bRes <- dialResult{u: u, err: dialErr}
+	}()
+
+	var a, b *dialResult
+	for a == nil || b == nil {
+		select {
+		case r := <-aRes:
+			a = &r
+		case r := <-bRes:
+			b = &r
+		}
+
+		switch {
+		case a != nil && a.err == nil:
+			closeLoserAsync(b, bRes)
+
+			return a.u, nil
+		case b != nil && b.err == nil:
+			closeLoserAsync(a, aRes)
+
+			return b.u, nil
+		}
+	}
+
+	return nil, fmt.Errorf("negotiating upstream transport: %v; %w", a.err, b.err)
+}
+
+// closeLoserAsync closes result's Upstream if it already arrived and
+// succeeded, or arranges to close it once it does, so that the winning side
+// of raceUpstreams never has to block on the loser.
+func closeLoserAsync(result *dialResult, pending <-chan dialResult) {
+	if result != nil {
+		if result.err == nil {
+			_ = result.u.Close()
+		}
+
+		return
+	}
+
+	go func() {
+		r := <-pending
+		if r.err == nil {
+			_ = r.u.Close()
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubUpstream is a bare-bones [Upstream] used to exercise raceUpstreams
+// without touching the network.
+type stubUpstream struct {
+	addr   string
+	closed bool
+}
+
+// type check
+var _ Upstream = (*stubUpstream)(nil)
+
+func (u *stubUpstream) Address() string { return u.addr }
+
+func (u *stubUpstream) Exchange(_ *dns.Msg) (resp *dns.Msg, err error) { return new(dns.Msg), nil }
+
+func (u *stubUpstream) Close() (err error) {
+	u.closed = true
+
+	return nil
+}
+
+// TestRaceUpstreams_picksFaster asserts that raceUpstreams returns whichever
+// dial function reaches a successful result first, and closes the loser.
+func TestRaceUpstreams_picksFaster(t *testing.T) {
+	t.Run("a_faster", func(t *testing.T) {
+		loser := &stubUpstream{addr: "b"}
+		winner, err := raceUpstreams(
+			func() (Upstream, error) {
+				return &stubUpstream{addr: "a"}, nil
+			},
+			func() (Upstream, error) {
+				time.Sleep(50 * time.Millisecond)
+
+				return loser, nil
+			},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if winner.Address() != "a" {
+			t.Errorf("got winner %q, want %q", winner.Address(), "a")
+		}
+
+		waitClosed(t, loser)
+	})
+
+	t.Run("b_faster", func(t *testing.T) {
+		loser := &stubUpstream{addr: "a"}
+		winner, err := raceUpstreams(
+			func() (Upstream, error) {
+				time.Sleep(50 * time.Millisecond)
+
+				return loser, nil
+			},
+			func() (Upstream, error) {
+				return &stubUpstream{addr: "b"}, nil
+			},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if winner.Address() != "b" {
+			t.Errorf("got winner %q, want %q", winner.Address(), "b")
+		}
+
+		waitClosed(t, loser)
+	})
+
+	t.Run("falls_back_on_error", func(t *testing.T) {
+		winner, err := raceUpstreams(
+			func() (Upstream, error) {
+				return nil, fmt.Errorf("a: unreachable")
+			},
+			func() (Upstream, error) {
+				return &stubUpstream{addr: "b"}, nil
+			},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if winner.Address() != "b" {
+			t.Errorf("got winner %q, want %q", winner.Address(), "b")
+		}
+	})
+
+	t.Run("both_fail", func(t *testing.T) {
+		_, err := raceUpstreams(
+			func() (Upstream, error) {
+				return nil, fmt.Errorf("a: unreachable")
+			},
+			func() (Upstream, error) {
+				return nil, fmt.Errorf("b: unreachable")
+			},
+		)
+		if err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+	})
+}
+
+// waitClosed polls until u.closed is true or the test times out, since
+// raceUpstreams closes the losing side asynchronously.
+func waitClosed(t *testing.T, u *stubUpstream) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if u.closed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Errorf("loser upstream %q was never closed", u.addr)
+}
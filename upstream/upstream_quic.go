@@ -3,7 +3,9 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"runtime"
@@ -42,8 +44,86 @@ const (
 	//
 	// See https://datatracker.ietf.org/doc/rfc9250.
 	NextProtoDQ = "doq"
+
+	// defaultQUICTokenStoreOrigins is the default maxOrigins passed to
+	// quic.NewLRUTokenStore when [Options.QUICTokenStoreOrigins] is zero.
+	defaultQUICTokenStoreOrigins = 1
+
+	// defaultQUICTokensPerOrigin is the default tokensPerOrigin passed to
+	// quic.NewLRUTokenStore when [Options.QUICTokensPerOrigin] is zero.
+	defaultQUICTokensPerOrigin = 10
 )
 
+// QUICZeroRTTPolicy controls whether a [dnsOverQUIC] upstream is allowed to
+// use 0-RTT (early data) when establishing new connections.  0-RTT trades
+// off some replay safety for a faster handshake on reconnects, which is not
+// appropriate for every deployment.
+type QUICZeroRTTPolicy int
+
+const (
+	// QUICZeroRTTAuto uses 0-RTT opportunistically whenever a token for the
+	// server is available, same as dnsproxy's historical behavior.
+	QUICZeroRTTAuto QUICZeroRTTPolicy = iota
+
+	// QUICZeroRTTDisabled never attempts 0-RTT and does not keep a
+	// TokenStore at all.
+	QUICZeroRTTDisabled
+
+	// QUICZeroRTTRequired only ever accepts connections that were actually
+	// established with 0-RTT, and fails the connection attempt otherwise.
+	QUICZeroRTTRequired
+)
+
+// QUICObserver receives structured notifications about the lifecycle of a
+// DoQ upstream's QUIC connections and streams.  Implementations must be
+// safe for concurrent use, since a [dnsOverQUIC] may invoke them from
+// multiple goroutines at once.  See the quicmetrics subpackage for a
+// Prometheus-backed implementation.
+type QUICObserver interface {
+	// OnHandshake is called every time a new QUIC connection finishes its
+	// handshake (successfully or not is reflected by the caller only
+	// invoking this on success).  resumed indicates a TLS session
+	// resumption, and zeroRTTAccepted indicates the server accepted 0-RTT
+	// early data.
+	OnHandshake(duration time.Duration, resumed, zeroRTTAccepted bool)
+
+	// OnRetry is called every time dnsOverQUIC decides to re-create its
+	// QUIC connection and retry a query because of reason.  attempt is the
+	// 1-based retry attempt number.
+	OnRetry(reason error, attempt int)
+
+	// OnConnectionClose is called every time the connection pool closes one
+	// of its QUIC connections, whether due to an error, idle eviction, or a
+	// graceful shutdown.  Connections that openConnection closes before
+	// handing them to the pool are not reported.
+	OnConnectionClose(code quic.ApplicationErrorCode, reason string)
+
+	// OnStreamRTT is called after a query/response exchange completes
+	// successfully on a single QUIC stream, with the time elapsed between
+	// opening the stream and finishing reading the response.
+	OnStreamRTT(duration time.Duration)
+}
+
+// noopQUICObserver is the zero-cost [QUICObserver] used when
+// [Options.QUICObserver] is not set.
+type noopQUICObserver struct{}
+
+// type check
+var _ QUICObserver = noopQUICObserver{}
+
+// OnHandshake implements the [QUICObserver] interface for noopQUICObserver.
+func (noopQUICObserver) OnHandshake(_ time.Duration, _, _ bool) {}
+
+// OnRetry implements the [QUICObserver] interface for noopQUICObserver.
+func (noopQUICObserver) OnRetry(_ error, _ int) {}
+
+// OnConnectionClose implements the [QUICObserver] interface for
+// noopQUICObserver.
+func (noopQUICObserver) OnConnectionClose(_ quic.ApplicationErrorCode, _ string) {}
+
+// OnStreamRTT implements the [QUICObserver] interface for noopQUICObserver.
+func (noopQUICObserver) OnStreamRTT(_ time.Duration) {}
+
 // compatProtoDQ is a list of ALPN tokens used by a QUIC connection.
 // NextProtoDQ is the latest draft version supported by dnsproxy, but it also
 // includes previous drafts.
@@ -68,9 +148,30 @@ type dnsOverQUIC struct {
 	// re-create the connection.
 	quicConfig *quic.Config
 
-	// conn is the current active QUIC connection.  It can be closed and
-	// re-opened when needed.
-	conn quic.Connection
+	// pool is the pool of QUIC connections to the upstream.  Unlike a single
+	// cached connection, the pool can keep several connections open at once
+	// and evict unhealthy ones without disrupting streams in flight on other
+	// connections.
+	pool *quicConnPool
+
+	// zeroRTT is the 0-RTT policy to apply when opening new connections.
+	zeroRTT QUICZeroRTTPolicy
+
+	// customTokenStore is the user-supplied quic.TokenStore, if any.  When
+	// set, it takes precedence over the in-memory LRU store and is never
+	// replaced by resetQUICConfig, since the user is expected to manage its
+	// lifetime themselves (e.g. a disk-backed store).
+	customTokenStore quic.TokenStore
+
+	// tokenStoreOrigins and tokensPerOrigin size the in-memory LRU token
+	// store used when customTokenStore is nil.
+	tokenStoreOrigins int
+	tokensPerOrigin   int
+
+	// observer receives structured telemetry about this upstream's QUIC
+	// connections and streams.  It is never nil: it falls back to
+	// noopQUICObserver{} when [Options.QUICObserver] is not set.
+	observer QUICObserver
 
 	// bytesPool is a *sync.Pool we use to store byte buffers in.  These byte
 	// buffers are used to read responses from the upstream.
@@ -79,9 +180,6 @@ type dnsOverQUIC struct {
 	// quicConfigMu protects quicConfig.
 	quicConfigMu sync.Mutex
 
-	// connMu protects conn.
-	connMu sync.RWMutex
-
 	// bytesPoolGuard protects bytesPool.
 	bytesPoolMu sync.Mutex
 
@@ -101,14 +199,14 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 		return nil, err
 	}
 
-	u = &dnsOverQUIC{
-		getDialer: getDialer,
-		addr:      addr,
-		quicConfig: &quic.Config{
-			KeepAlivePeriod: QUICKeepAlivePeriod,
-			TokenStore:      newQUICTokenStore(),
-			Tracer:          opts.QUICTracer,
-		},
+	doq := &dnsOverQUIC{
+		getDialer:         getDialer,
+		addr:              addr,
+		zeroRTT:           opts.QUICZeroRTT,
+		customTokenStore:  opts.QUICTokenStore,
+		tokenStoreOrigins: opts.QUICTokenStoreOrigins,
+		tokensPerOrigin:   opts.QUICTokensPerOrigin,
+		observer:          opts.QUICObserver,
 		tlsConf: &tls.Config{
 			ServerName:   addr.Hostname(),
 			RootCAs:      RootCAs,
@@ -125,12 +223,35 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 		},
 		timeout: opts.Timeout,
 	}
+	if doq.observer == nil {
+		doq.observer = noopQUICObserver{}
+	}
+	doq.quicConfig = &quic.Config{
+		KeepAlivePeriod: QUICKeepAlivePeriod,
+		TokenStore:      doq.newQUICTokenStore(),
+		Tracer:          opts.QUICTracer,
+	}
+	doq.pool = newQUICConnPool(
+		doq.openConnection,
+		opts.QUICPoolSize,
+		opts.QUICMaxStreamsPerConn,
+		opts.QUICIdleTimeout,
+		doq.observer,
+	)
+
+	u = doq
 
 	runtime.SetFinalizer(u, (*dnsOverQUIC).Close)
 
 	return u, nil
 }
 
+// Stats returns a snapshot of the current QUIC connection pool state, for
+// callers that want to observe pool churn.
+func (p *dnsOverQUIC) Stats() (s QUICPoolStats) {
+	return p.pool.stats()
+}
+
 // Address implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Address() string { return p.addr.String() }
 
@@ -150,10 +271,11 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 
 	// Check if there was already an active conn before sending the request.
 	// We'll only attempt to re-connect if there was one.
-	hasConnection := p.hasConnection()
+	hasConnection := p.pool.stats().OpenConns > 0
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeQUIC(m)
+	var pc *pooledQUICConn
+	resp, pc, err = p.exchangeQUIC(m)
 
 	// Make up to 2 attempts to re-open the QUIC connection and send the request
 	// again.  There are several cases where this workaround is necessary to
@@ -162,18 +284,22 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	// refuses to open a 0-RTT connection.
 	for i := 0; hasConnection && p.shouldRetry(err) && i < 2; i++ {
 		log.Debug("re-creating the QUIC connection and retrying due to %v", err)
+		p.observer.OnRetry(err, i+1)
 
-		// Close the active connection to make sure we'll try to re-connect.
-		p.closeConnWithError(err)
+		// Mark only the connection we just used as unhealthy, so that
+		// in-flight queries on other pooled connections are unaffected.
+		if pc != nil {
+			p.markConnUnhealthy(pc, err)
+		}
 
 		// Retry sending the request.
-		resp, err = p.exchangeQUIC(m)
+		resp, pc, err = p.exchangeQUIC(m)
 	}
 
-	if err != nil {
+	if err != nil && pc != nil {
 		// If we're unable to exchange messages, make sure the connection is
-		// closed and signal about an internal error.
-		p.closeConnWithError(err)
+		// marked unhealthy and signal about an internal error.
+		p.markConnUnhealthy(pc, err)
 	}
 
 	return resp, err
@@ -181,42 +307,41 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 
 // Close implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Close() (err error) {
-	p.connMu.Lock()
-	defer p.connMu.Unlock()
-
 	runtime.SetFinalizer(p, nil)
 
-	if p.conn != nil {
-		err = p.conn.CloseWithError(QUICCodeNoError, "")
-	}
-
-	return err
+	return p.pool.closeAll()
 }
 
 // exchangeQUIC attempts to open a QUIC connection, send the DNS message
-// through it and return the response it got from the server.
-func (p *dnsOverQUIC) exchangeQUIC(m *dns.Msg) (resp *dns.Msg, err error) {
-	var conn quic.Connection
-	conn, err = p.getConnection(true)
+// through it and return the response it got from the server, along with the
+// pooled connection it used.  It opens its own quic.Stream on the connection
+// it draws from the pool, so it is safe to call this method concurrently:
+// concurrent callers are multiplexed over independent streams, possibly on
+// independent connections, instead of being serialized behind each other.
+func (p *dnsOverQUIC) exchangeQUIC(m *dns.Msg) (resp *dns.Msg, pc *pooledQUICConn, err error) {
+	pc, err = p.pool.get()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer pc.release()
 
 	var buf []byte
 	buf, err = m.Pack()
 	if err != nil {
-		return nil, fmt.Errorf("failed to pack DNS message for DoQ: %w", err)
+		return nil, pc, fmt.Errorf("failed to pack DNS message for DoQ: %w", err)
 	}
 
+	start := time.Now()
+
 	var stream quic.Stream
-	stream, err = p.openStream(conn)
+	stream, err = p.openStream(pc.conn)
 	if err != nil {
-		return nil, err
+		return nil, pc, err
 	}
 
 	_, err = stream.Write(proxyutil.AddPrefix(buf))
 	if err != nil {
-		return nil, fmt.Errorf("failed to write to a QUIC stream: %w", err)
+		return nil, pc, fmt.Errorf("failed to write to a QUIC stream: %w", err)
 	}
 
 	// The client MUST send the DNS query over the selected stream, and MUST
@@ -225,7 +350,12 @@ func (p *dnsOverQUIC) exchangeQUIC(m *dns.Msg) (resp *dns.Msg, err error) {
 	// write-direction of the stream, but does not prevent reading from it.
 	_ = stream.Close()
 
-	return p.readMsg(stream)
+	resp, err = p.readMsg(stream)
+	if err == nil {
+		p.observer.OnStreamRTT(time.Since(start))
+	}
+
+	return resp, pc, err
 }
 
 // shouldRetry checks what error we received and decides whether it is required
@@ -252,46 +382,6 @@ func (p *dnsOverQUIC) getBytesPool() (pool *sync.Pool) {
 	return p.bytesPool
 }
 
-// getConnection opens or returns an existing quic.Connection. useCached
-// argument controls whether we should try to use the existing cached
-// connection.  If it is false, we will forcibly create a new connection and
-// close the existing one if needed.
-func (p *dnsOverQUIC) getConnection(useCached bool) (quic.Connection, error) {
-	var conn quic.Connection
-	p.connMu.RLock()
-	conn = p.conn
-	if conn != nil && useCached {
-		p.connMu.RUnlock()
-
-		return conn, nil
-	}
-	if conn != nil {
-		// we're recreating the connection, let's create a new one.
-		_ = conn.CloseWithError(QUICCodeNoError, "")
-	}
-	p.connMu.RUnlock()
-
-	p.connMu.Lock()
-	defer p.connMu.Unlock()
-
-	var err error
-	conn, err = p.openConnection()
-	if err != nil {
-		return nil, err
-	}
-	p.conn = conn
-
-	return conn, nil
-}
-
-// hasConnection returns true if there's an active QUIC connection.
-func (p *dnsOverQUIC) hasConnection() (ok bool) {
-	p.connMu.Lock()
-	defer p.connMu.Unlock()
-
-	return p.conn != nil
-}
-
 // getQUICConfig returns the QUIC config in a thread-safe manner.  Note, that
 // this method returns a pointer, it is forbidden to change its properties.
 func (p *dnsOverQUIC) getQUICConfig() (c *quic.Config) {
@@ -302,13 +392,18 @@ func (p *dnsOverQUIC) getQUICConfig() (c *quic.Config) {
 }
 
 // resetQUICConfig re-creates the tokens store as we may need to use a new one
-// if we failed to connect.
+// if we failed to connect.  It does nothing when a customTokenStore was
+// supplied, since its lifetime is managed by the caller, not by dnsproxy.
 func (p *dnsOverQUIC) resetQUICConfig() {
+	if p.customTokenStore != nil {
+		return
+	}
+
 	p.quicConfigMu.Lock()
 	defer p.quicConfigMu.Unlock()
 
 	p.quicConfig = p.quicConfig.Clone()
-	p.quicConfig.TokenStore = newQUICTokenStore()
+	p.quicConfig.TokenStore = p.newQUICTokenStore()
 }
 
 // openStream opens a new QUIC stream for the specified connection.
@@ -316,23 +411,13 @@ func (p *dnsOverQUIC) openStream(conn quic.Connection) (quic.Stream, error) {
 	ctx, cancel := p.withDeadline(context.Background())
 	defer cancel()
 
-	stream, err := conn.OpenStreamSync(ctx)
-	if err == nil {
-		return stream, nil
-	}
-
-	// We can get here if the old QUIC connection is not valid anymore.  We
-	// should try to re-create the connection again in this case.
-	newConn, err := p.getConnection(false)
-	if err != nil {
-		return nil, err
-	}
-	// Open a new stream.
-	return newConn.OpenStreamSync(ctx)
+	return conn.OpenStreamSync(ctx)
 }
 
 // openConnection opens a new QUIC connection.
 func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
+	start := time.Now()
+
 	dialContext, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("failed to bootstrap QUIC connection: %w", err)
@@ -358,41 +443,72 @@ func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
 	ctx, cancel := p.withDeadline(context.Background())
 	defer cancel()
 
-	conn, err = quic.DialAddrEarlyContext(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	if p.zeroRTT == QUICZeroRTTDisabled {
+		conn, err = quic.DialAddrContext(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+		if err != nil {
+			return nil, fmt.Errorf("opening quic connection to %s: %w", p.addr, err)
+		}
+		p.observer.OnHandshake(time.Since(start), conn.ConnectionState().TLS.DidResume, false)
+
+		return conn, nil
+	}
+
+	var earlyConn quic.EarlyConnection
+	earlyConn, err = quic.DialAddrEarlyContext(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
 	if err != nil {
 		return nil, fmt.Errorf("opening quic connection to %s: %w", p.addr, err)
 	}
 
-	return conn, nil
-}
+	if p.zeroRTT == QUICZeroRTTRequired {
+		// Wait out the handshake so that ConnectionState reflects whether
+		// 0-RTT was actually used, and fail closed if it was not.
+		select {
+		case <-earlyConn.HandshakeComplete():
+		case <-ctx.Done():
+			_ = earlyConn.CloseWithError(QUICCodeNoError, "")
 
-// closeConnWithError closes the active connection with error to make sure that
-// new queries were processed in another connection.  We can do that in the case
-// of a fatal error.
-func (p *dnsOverQUIC) closeConnWithError(err error) {
-	p.connMu.Lock()
-	defer p.connMu.Unlock()
+			return nil, fmt.Errorf("opening quic connection to %s: %w", p.addr, ctx.Err())
+		}
 
-	if p.conn == nil {
-		// Do nothing, there's no active conn anyways.
-		return
-	}
+		if !earlyConn.ConnectionState().Used0RTT {
+			_ = earlyConn.CloseWithError(QUICCodeNoError, "")
 
-	code := QUICCodeNoError
-	if err != nil {
-		code = QUICCodeInternalError
+			return nil, fmt.Errorf(
+				"opening quic connection to %s: server did not accept 0-RTT as required",
+				p.addr,
+			)
+		}
+
+		// The handshake has already completed above, so ConnectionState
+		// already reflects the final 0-RTT outcome.
+		connState := earlyConn.ConnectionState()
+		p.observer.OnHandshake(time.Since(start), connState.TLS.DidResume, connState.Used0RTT)
+	} else {
+		// With QUICZeroRTTAuto the connection is usable before the
+		// handshake finishes, so report the handshake asynchronously
+		// instead of delaying the caller.
+		go func() {
+			<-earlyConn.HandshakeComplete()
+
+			connState := earlyConn.ConnectionState()
+			p.observer.OnHandshake(time.Since(start), connState.TLS.DidResume, connState.Used0RTT)
+		}()
 	}
 
+	return earlyConn, nil
+}
+
+// markConnUnhealthy flags pc as unhealthy in the pool so that subsequent
+// queries are routed to a different (or newly opened) connection, removes
+// it from the pool, and closes it asynchronously.  We can do that in the
+// case of a fatal error.
+func (p *dnsOverQUIC) markConnUnhealthy(pc *pooledQUICConn, err error) {
 	if errors.Is(err, quic.Err0RTTRejected) {
 		// Reset the TokenStore only if 0-RTT was rejected.
 		p.resetQUICConfig()
 	}
 
-	err = p.conn.CloseWithError(code, "")
-	if err != nil {
-		log.Error("failed to close the conn: %v", err)
-	}
-	p.conn = nil
+	p.pool.markUnhealthy(pc, err)
 }
 
 // readMsg reads the incoming DNS message from the QUIC stream.
@@ -402,19 +518,32 @@ func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
 
 	defer pool.Put(bufPtr)
 
-	respBuf := *bufPtr
-	n, err := stream.Read(respBuf)
-	if err != nil && n == 0 {
+	// All DNS messages (queries and responses) sent over DoQ connections MUST
+	// be encoded as a 2-octet length field followed by the message content as
+	// specified in [RFC1035].  Read the length prefix first so that we know
+	// exactly how many bytes of message content to expect, then read that
+	// many bytes in full, since a single stream.Read is not guaranteed to
+	// return the whole message in one go.
+	var lenBuf [2]byte
+	_, err = io.ReadFull(stream, lenBuf[:])
+	if err != nil {
+		return nil, fmt.Errorf("reading length prefix from %s: %w", p.addr, err)
+	}
+
+	respLen := binary.BigEndian.Uint16(lenBuf[:])
+
+	// respLen is a uint16, and the pooled buffer is always sized to
+	// dns.MaxMsgSize (65535, the maximum possible uint16 value), so respBuf
+	// always has enough capacity for respLen bytes.
+	respBuf := (*bufPtr)[:respLen]
+
+	_, err = io.ReadFull(stream, respBuf)
+	if err != nil {
 		return nil, fmt.Errorf("reading response from %s: %w", p.addr, err)
 	}
 
-	// All DNS messages (queries and responses) sent over DoQ connections MUST
-	// be encoded as a 2-octet length field followed by the message content as
-	// specified in [RFC1035].
-	// IMPORTANT: Note, that we ignore this prefix here as this implementation
-	// does not support receiving multiple messages over a single connection.
 	m = new(dns.Msg)
-	err = m.Unpack(respBuf[2:])
+	err = m.Unpack(respBuf)
 	if err != nil {
 		return nil, fmt.Errorf("unpacking response from %s: %w", p.addr, err)
 	}
@@ -422,14 +551,36 @@ func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
 	return m, nil
 }
 
-// newQUICTokenStore creates a new quic.TokenStore that is necessary to have
-// in order to benefit from 0-RTT.
-func newQUICTokenStore() (s quic.TokenStore) {
+// newQUICTokenStore creates a new in-memory quic.TokenStore that is
+// necessary to have in order to benefit from 0-RTT.  origins and perOrigin
+// fall back to their respective defaults when zero or negative.
+func newQUICTokenStore(origins, perOrigin int) (s quic.TokenStore) {
 	// You can read more on address validation here:
 	// https://datatracker.ietf.org/doc/html/rfc9000#section-8.1
-	// Setting maxOrigins to 1 and tokensPerOrigin to 10 assuming that this is
-	// more than enough for the way we use it (one connection per upstream).
-	return quic.NewLRUTokenStore(1, 10)
+	if origins <= 0 {
+		origins = defaultQUICTokenStoreOrigins
+	}
+	if perOrigin <= 0 {
+		perOrigin = defaultQUICTokensPerOrigin
+	}
+
+	return quic.NewLRUTokenStore(origins, perOrigin)
+}
+
+// newQUICTokenStore returns the quic.TokenStore to use for new connections,
+// respecting the configured [QUICZeroRTTPolicy]: nil when 0-RTT is
+// disabled, the user-supplied store when one was given, or a sized in-memory
+// LRU store otherwise.
+func (p *dnsOverQUIC) newQUICTokenStore() (s quic.TokenStore) {
+	if p.zeroRTT == QUICZeroRTTDisabled {
+		return nil
+	}
+
+	if p.customTokenStore != nil {
+		return p.customTokenStore
+	}
+
+	return newQUICTokenStore(p.tokenStoreOrigins, p.tokensPerOrigin)
 }
 
 // isQUICRetryError checks the error and determines whether it may signal that
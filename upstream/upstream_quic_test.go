@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// fakeQUICStream is a [quic.Stream] that only implements Read, reading from
+// an underlying io.Reader; every other method panics if called, since
+// readMsg never exercises them.
+type fakeQUICStream struct {
+	quic.Stream
+
+	r io.Reader
+}
+
+func (s *fakeQUICStream) Read(p []byte) (n int, err error) { return s.r.Read(p) }
+
+// chunkedReader dribbles out the underlying bytes a few at a time, so that a
+// single Read never returns the whole message, the way a real QUIC stream
+// can.
+type chunkedReader struct {
+	b         []byte
+	chunkSize int
+}
+
+func (r *chunkedReader) Read(p []byte) (n int, err error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+
+	n = r.chunkSize
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.b) {
+		n = len(r.b)
+	}
+
+	copy(p, r.b[:n])
+	r.b = r.b[n:]
+
+	return n, nil
+}
+
+// packMsg packs m and prepends the 2-octet DoQ length prefix.
+func packMsg(t *testing.T, m *dns.Msg) (framed []byte) {
+	t.Helper()
+
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("packing message: %v", err)
+	}
+
+	framed = make([]byte, 2+len(buf))
+	framed[0] = byte(len(buf) >> 8)
+	framed[1] = byte(len(buf))
+	copy(framed[2:], buf)
+
+	return framed
+}
+
+func TestDNSOverQUIC_readMsg(t *testing.T) {
+	p := &dnsOverQUIC{}
+
+	t.Run("split_across_reads", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		framed := packMsg(t, query)
+
+		stream := &fakeQUICStream{r: &chunkedReader{b: framed, chunkSize: 3}}
+
+		got, err := p.readMsg(stream)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Question[0].Name != "example.com." {
+			t.Errorf("got question %q, want %q", got.Question[0].Name, "example.com.")
+		}
+	})
+
+	t.Run("truncated_stream", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		framed := packMsg(t, query)
+
+		// Cut the framed message short, after the length prefix but before
+		// the full body has arrived.
+		stream := &fakeQUICStream{r: bytes.NewReader(framed[:len(framed)-1])}
+
+		_, err := p.readMsg(stream)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("got error %v, want it to wrap %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+
+	t.Run("zero_length_response", func(t *testing.T) {
+		stream := &fakeQUICStream{r: bytes.NewReader([]byte{0x00, 0x00})}
+
+		_, err := p.readMsg(stream)
+		if err == nil {
+			t.Fatal("expected an error unpacking a zero-length response, got nil")
+		}
+	})
+}